@@ -0,0 +1,79 @@
+package kvlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression codec names accepted by KDBOptions.Compression.
+const (
+	CodecNone = "none"
+	CodecZstd = "zstd"
+	CodecS2   = "s2"
+	CodecGzip = "gzip"
+
+	// DefaultCodec is used when KDBOptions.Compression is unset.
+	DefaultCodec = CodecZstd
+)
+
+// Compress compresses data under codec. An empty codec is treated as
+// CodecNone.
+func Compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", CodecNone:
+		return data, nil
+	case CodecZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil), nil
+	case CodecS2:
+		return s2.Encode(nil, data), nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("kvlog: unknown compression codec %q", codec)
+	}
+}
+
+// Decompress reverses Compress. An empty codec is treated as CodecNone, so
+// values written before compression support was added continue to work.
+func Decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", CodecNone:
+		return data, nil
+	case CodecZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(data, nil)
+	case CodecS2:
+		return s2.Decode(nil, data)
+	case CodecGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return io.ReadAll(gz)
+	default:
+		return nil, fmt.Errorf("kvlog: unknown compression codec %q", codec)
+	}
+}
@@ -0,0 +1,736 @@
+// Package sqlstore implements kvlog.Store on top of database/sql, shared
+// by the kvlog/sqlite and kvlog/postgres drivers. The two tables mirror
+// the MongoDB "kvlog"/"value" collections: a kvlog table holding one row
+// per Set, uniquely indexed on (k, labels_hash, ts DESC), and a
+// content-addressed value table keyed on the SHA-1 computed by
+// kvlog.ValueID.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gavincarr/kvlog"
+)
+
+// pollInterval is how often Watch/WatchPrefix poll for new rows, in the
+// absence of a change-stream-like primitive on SQL backends.
+const pollInterval = 200 * time.Millisecond
+
+// Dialect captures the handful of ways the sqlite and postgres drivers
+// differ: the database/sql driver name to Open, how to turn a DSN from a
+// kvlog URI, and the placeholder syntax used in queries.
+type Dialect struct {
+	// DriverName is the name the driver registered with database/sql
+	// under (e.g. "sqlite3", "postgres").
+	DriverName string
+	// DSN converts a kvlog.KDBOptions URI into the DSN expected by the
+	// database/sql driver.
+	DSN func(uri string) string
+	// Placeholder returns the parameter placeholder for the n'th
+	// (1-based) bind argument in a query, e.g. "?" or fmt.Sprintf("$%d", n).
+	Placeholder func(n int) string
+	// MaxOpenConns caps the size of the connection pool database/sql
+	// opens against the driver, if positive. Backends that serialize
+	// writes at the file level (e.g. sqlite) need this capped at 1 to
+	// avoid spurious "database is locked" errors from concurrent use of
+	// the same *sql.DB.
+	MaxOpenConns int
+}
+
+// Store implements kvlog.Store on top of a database/sql *sql.DB.
+type Store struct {
+	ctx         context.Context
+	db          *sql.DB
+	d           Dialect
+	compression string
+}
+
+// Open opens a database/sql connection per dialect and opts, returning a
+// *Store. Driver packages call this from their registered Factory.
+func Open(ctx context.Context, opts kvlog.KDBOptions, d Dialect) (*Store, error) {
+	db, err := sql.Open(d.DriverName, d.DSN(opts.URI))
+	if err != nil {
+		return nil, err
+	}
+	if d.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(d.MaxOpenConns)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		return nil, err
+	}
+
+	compression := opts.Compression
+	if compression == "" {
+		compression = kvlog.DefaultCodec
+	}
+
+	return &Store{ctx: ctx, db: db, d: d, compression: compression}, nil
+}
+
+// EnsureIndexes creates the kvlog/value/revision tables and the unique
+// (k, labels_hash, ts DESC) index, if they don't already exist.
+func (s *Store) EnsureIndexes() error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS kvlog (
+			k           TEXT NOT NULL,
+			ts          BIGINT NOT NULL,
+			v           TEXT NOT NULL DEFAULT '',
+			vid         TEXT NOT NULL DEFAULT '',
+			labels      TEXT NOT NULL DEFAULT '',
+			labels_hash TEXT NOT NULL DEFAULT '',
+			rev         BIGINT NOT NULL DEFAULT 0,
+			deleted     BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS kvlog_k_labels_hash_ts ON kvlog (k, labels_hash, ts DESC)`,
+		`CREATE TABLE IF NOT EXISTS value (
+			id       TEXT PRIMARY KEY,
+			v        BLOB NOT NULL,
+			codec    TEXT NOT NULL DEFAULT '',
+			orig_len BIGINT NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS revision (
+			id  INTEGER PRIMARY KEY,
+			seq BIGINT NOT NULL DEFAULT 0
+		)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := s.db.ExecContext(s.ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	var exists int
+	err := s.db.QueryRowContext(s.ctx, "SELECT COUNT(*) FROM revision WHERE id = 1").Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		if _, err := s.db.ExecContext(s.ctx, "INSERT INTO revision (id, seq) VALUES (1, 0)"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) ph(n int) string {
+	return s.d.Placeholder(n)
+}
+
+// encodeLabels marshals labels to the JSON stored in the kvlog.labels column.
+func encodeLabels(labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(labels)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeLabels unmarshals the kvlog.labels column back into a label map.
+func decodeLabels(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var labels map[string]string
+	if err := json.Unmarshal([]byte(s), &labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// findKVLogLatest finds the latest kvlog entry for key under labelsHash
+func (s *Store) findKVLogLatest(key, labelsHash string) (*kvlog.KVLog, error) {
+	kv := kvlog.KVLog{Key: key, LabelsHash: labelsHash}
+	var labelsJSON string
+	query := "SELECT ts, v, vid, labels, deleted FROM kvlog WHERE k = " + s.ph(1) +
+		" AND labels_hash = " + s.ph(2) + " ORDER BY ts DESC LIMIT 1"
+	err := s.db.QueryRowContext(s.ctx, query, key, labelsHash).Scan(&kv.TS, &kv.Val, &kv.VID, &labelsJSON, &kv.Deleted)
+	if err != nil {
+		return nil, err
+	}
+	if kv.Labels, err = decodeLabels(labelsJSON); err != nil {
+		return nil, err
+	}
+	return &kv, nil
+}
+
+// findKVLogAfter finds the first kvlog entry for key under labelsHash after ts
+func (s *Store) findKVLogAfter(key string, ts int64, labelsHash string) (*kvlog.KVLog, error) {
+	kv := kvlog.KVLog{Key: key, LabelsHash: labelsHash}
+	var labelsJSON string
+	query := "SELECT ts, v, vid, labels, deleted FROM kvlog WHERE k = " + s.ph(1) +
+		" AND labels_hash = " + s.ph(2) + " AND ts >= " + s.ph(3) + " ORDER BY ts ASC LIMIT 1"
+	err := s.db.QueryRowContext(s.ctx, query, key, labelsHash, ts).Scan(&kv.TS, &kv.Val, &kv.VID, &labelsJSON, &kv.Deleted)
+	if err != nil {
+		return nil, err
+	}
+	if kv.Labels, err = decodeLabels(labelsJSON); err != nil {
+		return nil, err
+	}
+	return &kv, nil
+}
+
+// findKVLogAfterRev finds the first kvlog entry for key under labelsHash
+// at or after revision rev
+func (s *Store) findKVLogAfterRev(key string, rev int64, labelsHash string) (*kvlog.KVLog, error) {
+	kv := kvlog.KVLog{Key: key, LabelsHash: labelsHash}
+	var labelsJSON string
+	query := "SELECT ts, v, vid, labels, rev, deleted FROM kvlog WHERE k = " + s.ph(1) +
+		" AND labels_hash = " + s.ph(2) + " AND rev >= " + s.ph(3) + " ORDER BY rev ASC LIMIT 1"
+	err := s.db.QueryRowContext(s.ctx, query, key, labelsHash, rev).Scan(&kv.TS, &kv.Val, &kv.VID, &labelsJSON, &kv.Rev, &kv.Deleted)
+	if err != nil {
+		return nil, err
+	}
+	if kv.Labels, err = decodeLabels(labelsJSON); err != nil {
+		return nil, err
+	}
+	return &kv, nil
+}
+
+// findValue finds value where id == vid, decompressing its content under
+// the codec it was stored with.
+func (s *Store) findValue(vid string) (string, error) {
+	var v []byte
+	var codec string
+	query := "SELECT v, codec FROM value WHERE id = " + s.ph(1)
+	err := s.db.QueryRowContext(s.ctx, query, vid).Scan(&v, &codec)
+	if err != nil {
+		return "", err
+	}
+	val, err := kvlog.Decompress(codec, v)
+	if err != nil {
+		return "", err
+	}
+	return string(val), nil
+}
+
+// nextRev atomically increments and returns the database's revision counter.
+func (s *Store) nextRev() (int64, error) {
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(s.ctx, "UPDATE revision SET seq = seq + 1 WHERE id = 1"); err != nil {
+		return 0, err
+	}
+	var rev int64
+	if err := tx.QueryRowContext(s.ctx, "SELECT seq FROM revision WHERE id = 1").Scan(&rev); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// CurrentRev returns the most recently issued revision, or 0 if no entries
+// have been set yet.
+func (s *Store) CurrentRev() (int64, error) {
+	var rev int64
+	err := s.db.QueryRowContext(s.ctx, "SELECT seq FROM revision WHERE id = 1").Scan(&rev)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// Set sets the current value for key to val (if not already val)
+func (s *Store) Set(key, val string) error {
+	return s.SetWithLabels(key, val, nil)
+}
+
+// SetWithLabels sets the current value for key, scoped to labels, to val
+// (if not already val)
+func (s *Store) SetWithLabels(key, val string, labels map[string]string) error {
+	val = strings.TrimSpace(val)
+	vlen := len(val)
+	labelsHash := kvlog.LabelsHash(labels)
+	labelsJSON, err := encodeLabels(labels)
+	if err != nil {
+		return err
+	}
+
+	vid := ""
+	if vlen > kvlog.MaxInlineValueLength {
+		// find or insert value record
+		vid = kvlog.ValueID(val)
+		_, err := s.findValue(vid)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err != nil {
+			// vid not found - insert
+			compressed, err := kvlog.Compress(s.compression, []byte(val))
+			if err != nil {
+				return err
+			}
+			query := "INSERT INTO value (id, v, codec, orig_len) VALUES (" +
+				s.ph(1) + ", " + s.ph(2) + ", " + s.ph(3) + ", " + s.ph(4) + ")"
+			if _, err := s.db.ExecContext(s.ctx, query, vid, compressed, s.compression, vlen); err != nil {
+				return err
+			}
+		}
+	}
+
+	// find or insert kvlog record
+	kv, err := s.findKVLogLatest(key, labelsHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err != sql.ErrNoRows && !kv.Deleted {
+		if vid != "" && kv.VID == vid {
+			// latest kvlog record matches, we're done
+			return nil
+		} else if vid == "" && kv.Val == val {
+			// latest kvlog record matches, we're done
+			return nil
+		}
+	}
+
+	rev, err := s.nextRev()
+	if err != nil {
+		return err
+	}
+
+	// No kvlog record found, or vids don't match - do an insert
+	newKV := kvlog.KVLog{Key: key, TS: time.Now().UnixNano(), LabelsHash: labelsHash, Rev: rev}
+	if vid == "" {
+		newKV.Val = val
+	} else {
+		newKV.VID = vid
+	}
+	query := "INSERT INTO kvlog (k, ts, v, vid, labels, labels_hash, rev) VALUES (" +
+		s.ph(1) + ", " + s.ph(2) + ", " + s.ph(3) + ", " + s.ph(4) + ", " + s.ph(5) + ", " + s.ph(6) + ", " + s.ph(7) + ")"
+	_, err = s.db.ExecContext(s.ctx, query, newKV.Key, newKV.TS, newKV.Val, newKV.VID, labelsJSON, newKV.LabelsHash, newKV.Rev)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Get fetches the latest value for key
+func (s *Store) Get(key string) (string, error) {
+	kv, err := s.findKVLogLatest(key, kvlog.LabelsHash(nil))
+	if err != nil {
+		return "", err
+	}
+	if kv.Deleted {
+		return "", kvlog.ErrDeleted
+	}
+	if kv.VID == "" {
+		return kv.Val, nil
+	}
+	return s.findValue(kv.VID)
+}
+
+// Delete writes a tombstone for key, preserving its history.
+func (s *Store) Delete(key string) error {
+	labelsHash := kvlog.LabelsHash(nil)
+	rev, err := s.nextRev()
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO kvlog (k, ts, labels_hash, rev, deleted) VALUES (" +
+		s.ph(1) + ", " + s.ph(2) + ", " + s.ph(3) + ", " + s.ph(4) + ", " + s.ph(5) + ")"
+	_, err = s.db.ExecContext(s.ctx, query, key, time.Now().UnixNano(), labelsHash, rev, true)
+	return err
+}
+
+// Purge hard-deletes the unlabeled history for key, and garbage-collects
+// any value documents no longer referenced by a surviving entry.
+func (s *Store) Purge(key string) error {
+	return s.PurgeWithLabels(key, nil)
+}
+
+// PurgeWithLabels is like Purge, but hard-deletes key's history scoped to
+// labels instead of its unlabeled history.
+func (s *Store) PurgeWithLabels(key string, labels map[string]string) error {
+	query := "DELETE FROM kvlog WHERE k = " + s.ph(1) + " AND labels_hash = " + s.ph(2)
+	if _, err := s.db.ExecContext(s.ctx, query, key, kvlog.LabelsHash(labels)); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(s.ctx, `DELETE FROM value WHERE id NOT IN (SELECT vid FROM kvlog WHERE vid <> '')`)
+	return err
+}
+
+// Keys returns the distinct keys beginning with prefix, ordered and
+// paginated by offset/limit. A limit of 0 means unbounded.
+func (s *Store) Keys(prefix string, offset, limit int) ([]string, error) {
+	query := "SELECT DISTINCT k FROM kvlog WHERE k LIKE " + s.ph(1) + ` ESCAPE '\' ORDER BY k` +
+		" LIMIT " + s.ph(2) + " OFFSET " + s.ph(3)
+	args := []interface{}{escapeLike(prefix) + "%", sqlLimit(limit), offset}
+	rows, err := s.db.QueryContext(s.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// GetAt fetches the first value for key after ts
+func (s *Store) GetAt(key string, ts int64) (string, error) {
+	kv, err := s.findKVLogAfter(key, ts, kvlog.LabelsHash(nil))
+	if err != nil {
+		return "", err
+	}
+	if kv.Deleted {
+		return "", kvlog.ErrDeleted
+	}
+	if kv.VID == "" {
+		return kv.Val, nil
+	}
+	return s.findValue(kv.VID)
+}
+
+// GetAtRev fetches the first value for key at or after revision rev
+func (s *Store) GetAtRev(key string, rev int64) (string, error) {
+	kv, err := s.findKVLogAfterRev(key, rev, kvlog.LabelsHash(nil))
+	if err != nil {
+		return "", err
+	}
+	if kv.Deleted {
+		return "", kvlog.ErrDeleted
+	}
+	if kv.VID == "" {
+		return kv.Val, nil
+	}
+	return s.findValue(kv.VID)
+}
+
+// GetByLabels fetches the latest KVLog for every key that has an entry
+// scoped to labels.
+func (s *Store) GetByLabels(labels map[string]string) ([]*kvlog.KVLog, error) {
+	labelsHash := kvlog.LabelsHash(labels)
+	query := "SELECT k1.k, k1.ts, k1.v, k1.vid, k1.labels, k1.deleted FROM kvlog k1" +
+		" WHERE k1.labels_hash = " + s.ph(1) +
+		" AND k1.ts = (SELECT MAX(k2.ts) FROM kvlog k2" +
+		" WHERE k2.k = k1.k AND k2.labels_hash = k1.labels_hash)"
+	rows, err := s.db.QueryContext(s.ctx, query, labelsHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*kvlog.KVLog
+	for rows.Next() {
+		kv := kvlog.KVLog{LabelsHash: labelsHash}
+		var labelsJSON string
+		if err := rows.Scan(&kv.Key, &kv.TS, &kv.Val, &kv.VID, &labelsJSON, &kv.Deleted); err != nil {
+			return nil, err
+		}
+		if kv.Deleted {
+			// a tombstoned key has no current value for this label
+			// combination, so omit it rather than surface an empty Val.
+			continue
+		}
+		if kv.Labels, err = decodeLabels(labelsJSON); err != nil {
+			return nil, err
+		}
+		if kv.VID != "" {
+			val, err := s.findValue(kv.VID)
+			if err != nil {
+				return nil, err
+			}
+			kv.Val = val
+		}
+		results = append(results, &kv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GetIterator returns an Iterator to fetch successive KVLog records,
+// in reverse timestamp order (i.e. latest first).
+// The caller is responsible for calling Close() on the returned
+// iterator once finished.
+func (s *Store) GetIterator(key string) (kvlog.Iterator, error) {
+	return s.getIterator(key, kvlog.LabelsHash(nil))
+}
+
+// GetIteratorByLabels is like GetIterator, but scoped to the history of
+// key under labels.
+func (s *Store) GetIteratorByLabels(key string, labels map[string]string) (kvlog.Iterator, error) {
+	return s.getIterator(key, kvlog.LabelsHash(labels))
+}
+
+func (s *Store) getIterator(key, labelsHash string) (kvlog.Iterator, error) {
+	query := "SELECT ts, v, vid, labels, rev, deleted FROM kvlog WHERE k = " + s.ph(1) +
+		" AND labels_hash = " + s.ph(2) + " ORDER BY ts DESC"
+	rows, err := s.db.QueryContext(s.ctx, query, key, labelsHash)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{store: s, rows: rows}, nil
+}
+
+// GetIteratorRev is like GetIterator, but bounded to the revision range
+// [fromRev, toRev]. A toRev of 0 means unbounded.
+func (s *Store) GetIteratorRev(key string, fromRev, toRev int64) (kvlog.Iterator, error) {
+	query := "SELECT ts, v, vid, labels, rev, deleted FROM kvlog WHERE k = " + s.ph(1) +
+		" AND labels_hash = " + s.ph(2) + " AND rev >= " + s.ph(3)
+	args := []interface{}{key, kvlog.LabelsHash(nil), fromRev}
+	if toRev > 0 {
+		query += " AND rev <= " + s.ph(4)
+		args = append(args, toRev)
+	}
+	query += " ORDER BY rev DESC"
+	rows, err := s.db.QueryContext(s.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{store: s, rows: rows}, nil
+}
+
+// GetIteratorRange is like GetIterator, but bounded to the timestamp range
+// [from, to], and paginated by offset/limit. A limit of 0 means unbounded.
+func (s *Store) GetIteratorRange(key string, from, to int64, offset, limit int) (kvlog.Iterator, error) {
+	query := "SELECT ts, v, vid, labels, rev, deleted FROM kvlog WHERE k = " + s.ph(1) +
+		" AND labels_hash = " + s.ph(2) + " AND ts >= " + s.ph(3) + " AND ts <= " + s.ph(4) +
+		" ORDER BY ts DESC LIMIT " + s.ph(5) + " OFFSET " + s.ph(6)
+	args := []interface{}{key, kvlog.LabelsHash(nil), from, to, sqlLimit(limit), offset}
+	rows, err := s.db.QueryContext(s.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{store: s, rows: rows}, nil
+}
+
+// Compact deletes kvlog entries older than rev, other than the latest entry
+// for each (key, labels) pair, and garbage-collects any value documents no
+// longer referenced by a surviving entry.
+func (s *Store) Compact(rev int64) error {
+	query := `DELETE FROM kvlog WHERE rev < ` + s.ph(1) + ` AND EXISTS (
+		SELECT 1 FROM kvlog k2
+		WHERE k2.k = kvlog.k AND k2.labels_hash = kvlog.labels_hash AND k2.ts > kvlog.ts
+	)`
+	if _, err := s.db.ExecContext(s.ctx, query, rev); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(s.ctx, `DELETE FROM value WHERE id NOT IN (SELECT vid FROM kvlog WHERE vid <> '')`)
+	return err
+}
+
+// Recompress rewrites every value row under codec, decompressing each
+// with its stored codec and recompressing before updating it in place.
+// It does not affect the content-address (id) of any value.
+func (s *Store) Recompress(codec string) error {
+	rows, err := s.db.QueryContext(s.ctx, "SELECT id, v, codec FROM value")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type row struct {
+		id, oldCodec string
+		v            []byte
+	}
+	var toUpdate []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.v, &r.oldCodec); err != nil {
+			return err
+		}
+		if r.oldCodec != codec {
+			toUpdate = append(toUpdate, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	query := "UPDATE value SET v = " + s.ph(1) + ", codec = " + s.ph(2) + ", orig_len = " + s.ph(3) +
+		" WHERE id = " + s.ph(4)
+	for _, r := range toUpdate {
+		raw, err := kvlog.Decompress(r.oldCodec, r.v)
+		if err != nil {
+			return err
+		}
+		compressed, err := kvlog.Compress(codec, raw)
+		if err != nil {
+			return err
+		}
+		if _, err := s.db.ExecContext(s.ctx, query, compressed, codec, len(raw), r.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlLimit turns a Store API limit of 0 ("unbounded") into a value usable
+// in a LIMIT clause, since OFFSET requires LIMIT to be present in some
+// dialects (notably sqlite).
+func sqlLimit(limit int) int64 {
+	if limit <= 0 {
+		return math.MaxInt64
+	}
+	return int64(limit)
+}
+
+// escapeLike escapes LIKE metacharacters in s, for use with the
+// "ESCAPE '\'" clause built into watch's queries.
+func escapeLike(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(s)
+}
+
+// watch polls for kvlog rows matching where/args, in ascending ts order,
+// delivering each as it's first seen until ctx is cancelled. This is a
+// fallback for backends without a native change-notification primitive.
+func (s *Store) watch(ctx context.Context, where string, args []interface{}) (<-chan *kvlog.KVLog, error) {
+	ch := make(chan *kvlog.KVLog)
+	sincePlaceholder := s.ph(len(args) + 1)
+
+	go func() {
+		defer close(ch)
+		since := time.Now().UnixNano()
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			query := "SELECT ts, k, v, vid, labels, rev, deleted FROM kvlog WHERE " + where +
+				" AND ts > " + sincePlaceholder + " ORDER BY ts ASC"
+			queryArgs := append(append([]interface{}{}, args...), since)
+			rows, err := s.db.QueryContext(ctx, query, queryArgs...)
+			if err != nil {
+				return
+			}
+			for rows.Next() {
+				kv := kvlog.KVLog{}
+				var labelsJSON string
+				if err := rows.Scan(&kv.TS, &kv.Key, &kv.Val, &kv.VID, &labelsJSON, &kv.Rev, &kv.Deleted); err != nil {
+					rows.Close()
+					return
+				}
+				if kv.Labels, err = decodeLabels(labelsJSON); err != nil {
+					rows.Close()
+					return
+				}
+				if kv.Val == "" && kv.VID != "" {
+					val, err := s.findValue(kv.VID)
+					if err != nil {
+						rows.Close()
+						return
+					}
+					kv.Val = val
+				}
+				since = kv.TS
+				select {
+				case ch <- &kv:
+				case <-ctx.Done():
+					rows.Close()
+					return
+				}
+			}
+			if err := rows.Err(); err != nil {
+				rows.Close()
+				return
+			}
+			rows.Close()
+		}
+	}()
+
+	return ch, nil
+}
+
+// Watch delivers every new KVLog set for key as it lands, until ctx is
+// cancelled, at which point the returned channel is closed.
+func (s *Store) Watch(ctx context.Context, key string) (<-chan *kvlog.KVLog, error) {
+	return s.watch(ctx, "k = "+s.ph(1), []interface{}{key})
+}
+
+// WatchPrefix is like Watch, but delivers every new KVLog whose key begins
+// with prefix.
+func (s *Store) WatchPrefix(ctx context.Context, prefix string) (<-chan *kvlog.KVLog, error) {
+	where := "k LIKE " + s.ph(1) + ` ESCAPE '\'`
+	return s.watch(ctx, where, []interface{}{escapeLike(prefix) + "%"})
+}
+
+// Disconnect releases any resources held by the Store.
+func (s *Store) Disconnect() {
+	s.db.Close()
+}
+
+// iterator implements kvlog.Iterator on top of sql.Rows.
+type iterator struct {
+	store *Store
+	rows  *sql.Rows
+	err   error
+}
+
+// Next returns the next KVLog record from the iterator, or nil
+// if no records remain, or an error occurred (which will be
+// available via Iterator.Err()).
+func (it *iterator) Next() *kvlog.KVLog {
+	if it.rows.Next() {
+		kv := kvlog.KVLog{}
+		var labelsJSON string
+		if err := it.rows.Scan(&kv.TS, &kv.Val, &kv.VID, &labelsJSON, &kv.Rev, &kv.Deleted); err != nil {
+			it.err = err
+			return nil
+		}
+		labels, err := decodeLabels(labelsJSON)
+		if err != nil {
+			it.err = err
+			return nil
+		}
+		kv.Labels = labels
+		if kv.Val == "" && kv.VID != "" {
+			val, err := it.store.findValue(kv.VID)
+			if err != nil {
+				it.err = err
+				return nil
+			}
+			kv.Val = val
+		}
+		return &kv
+	}
+	if err := it.rows.Err(); err != nil {
+		it.err = err
+		return nil
+	}
+	return nil
+}
+
+// Close marks the iterator as closed. Next() should not be
+// called again after the iterator has been closed.
+func (it *iterator) Close() {
+	it.rows.Close()
+}
+
+// Err returns the most recent error received from the iterator
+func (it *iterator) Err() error {
+	return it.err
+}
@@ -4,293 +4,290 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
 	"strings"
-	"time"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
 )
 
+// ErrDeleted is returned by Store.Get and friends when the most recent
+// entry for a key is a tombstone written by Store.Delete.
+var ErrDeleted = errors.New("kvlog: key deleted")
+
 const (
 	defaultURI           = "mongodb://localhost/"
 	defaultDBName        = "kvlog"
-	maxInlineValueLength = 200 // max number of characters in value to store inline in kvlog.v
+	MaxInlineValueLength = 200 // max number of characters in value to store inline in kvlog.v
 )
 
-// First-pass implementation: mongodb
+// KDBOptions holds the options used to construct a Store. URI determines
+// which registered driver is used: the scheme (e.g. "mongodb", "sqlite",
+// "postgres") is looked up in the driver registry and the remainder is
+// passed through to that driver's factory.
 type KDBOptions struct {
 	URI    string
 	DBName string
+	// Compression is the codec used to compress externalized values
+	// before they're written to the value store (see CodecZstd and
+	// friends). Defaults to CodecZstd if empty.
+	Compression string
 }
 
-type KDB struct {
-	ctx    context.Context
-	client *mongo.Client
-	db     *mongo.Database
-	kc     *mongo.Collection // kvlog collection
-	vc     *mongo.Collection // value collection
-}
-
+// KVLog represents a single logged value for a key at a point in time.
+// VID is set instead of Val when the value has been externalized to the
+// value store (see MaxInlineValueLength). Labels scopes the entry to a
+// label combination (see LabelsHash and Store.SetWithLabels); an entry
+// with no labels keeps an independent history from any labeled variant
+// of the same key.
 type KVLog struct {
-	Key string `bson:"k"`
-	TS  int64  `bson:"ts"`
-	Val string `bson:"v"`
-	vid string `bson:"vid"`
+	Key        string            `bson:"k"`
+	TS         int64             `bson:"ts"`
+	Val        string            `bson:"v"`
+	VID        string            `bson:"vid"`
+	Labels     map[string]string `bson:"labels,omitempty"`
+	LabelsHash string            `bson:"labels_hash"`
+	// Rev is the per-database monotonically increasing revision this
+	// entry was inserted at (see Store.CurrentRev), giving callers a
+	// stable cursor across clock skew that raw TS can't.
+	Rev int64 `bson:"rev"`
+	// Deleted marks this entry as a tombstone written by Store.Delete;
+	// Val and VID are both empty on a tombstone.
+	Deleted bool `bson:"deleted,omitempty"`
 }
 
+// Value is a content-addressed value record, keyed on the SHA-1 of its
+// (uncompressed) content, shared by keys whose value is identical. Val
+// holds the content compressed under Codec; OrigLen is the uncompressed
+// length.
 type Value struct {
-	ID  string `bson:"_id"`
-	Val string `bson:"v"`
+	ID      string `bson:"_id"`
+	Val     []byte `bson:"v"`
+	Codec   string `bson:"codec"`
+	OrigLen int    `bson:"orig_len"`
 }
 
-type Iterator struct {
-	kdb    *KDB
-	cursor *mongo.Cursor
-	err    error
-}
+// Store is the interface implemented by kvlog storage backends. Drivers
+// register a factory for constructing a Store via Register, and are
+// selected at runtime by the scheme of KDBOptions.URI (see NewKDBOptions).
+type Store interface {
+	// EnsureIndexes checks that the indexes required by the driver exist,
+	// creating them if necessary.
+	EnsureIndexes() error
 
-func createIndexes(ctx context.Context, coll *mongo.Collection) error {
-	// db.kvlog.createIndex({ k:1, ts:-1 }, { unique:true })
-	model := mongo.IndexModel{
-		Keys:    bson.D{{Key: "k", Value: 1}, {Key: "ts", Value: -1}},
-		Options: options.Index().SetName("k_ts").SetUnique(true),
-	}
-	_, err := coll.Indexes().CreateOne(ctx, model, nil)
-	if err != nil {
-		return err
-	}
-	return nil
-}
+	// Set sets the current value for key to val (if not already val).
+	Set(key, val string) error
 
-// NewKDBOptions creates a new connection to the kvlog database using
-// the ctx context and the given options, and returns *KDB. The caller is
-// responsible for calling KDB.Disconnect when completed.
-func NewKDBOptions(ctx context.Context, opts KDBOptions) (*KDB, error) {
-	if opts.URI == "" {
-		opts.URI = defaultURI
-	}
-	if opts.DBName == "" {
-		opts.DBName = defaultDBName
-	}
+	// SetWithLabels sets the current value for key, scoped to labels, to
+	// val (if not already val). A key's labeled and unlabeled histories
+	// are independent of one another.
+	SetWithLabels(key, val string, labels map[string]string) error
 
-	client, err := mongo.NewClient(options.Client().ApplyURI(opts.URI))
-	if err != nil {
-		return nil, err
-	}
+	// Get fetches the latest value for key.
+	Get(key string) (string, error)
 
-	err = client.Connect(ctx)
-	if err != nil {
-		return nil, err
-	}
+	// GetAt fetches the first value for key after ts.
+	GetAt(key string, ts int64) (string, error)
 
-	db := client.Database(opts.DBName)
-	kc := db.Collection("kvlog")
-	vc := db.Collection("value")
+	// GetAtRev fetches the first value for key at or after revision rev.
+	GetAtRev(key string, rev int64) (string, error)
 
-	// Check required indexes exist
-	err = createIndexes(ctx, kc)
-	if err != nil {
-		return nil, err
-	}
+	// CurrentRev returns the most recently issued revision, or 0 if no
+	// entries have been set yet.
+	CurrentRev() (int64, error)
 
-	kdb := KDB{ctx: ctx, client: client, db: db, kc: kc, vc: vc}
-	return &kdb, nil
-}
+	// GetByLabels fetches the latest KVLog for every key that has an
+	// entry scoped to labels.
+	GetByLabels(labels map[string]string) ([]*KVLog, error)
 
-// NewKDB creates a new connection to the kvlog database using the ctx
-// context and default options, and returns *KDB. The caller is
-// responsible for doing a Disconnect(ctx) on *KDB.client when completed.
-func NewKDB(ctx context.Context) (*KDB, error) {
-	return NewKDBOptions(ctx, KDBOptions{})
+	// GetIterator returns an Iterator to fetch successive KVLog records
+	// for key, in reverse timestamp order (i.e. latest first). The caller
+	// is responsible for calling Close() on the returned iterator once
+	// finished.
+	GetIterator(key string) (Iterator, error)
+
+	// GetIteratorByLabels is like GetIterator, but scoped to the history
+	// of key under labels.
+	GetIteratorByLabels(key string, labels map[string]string) (Iterator, error)
+
+	// GetIteratorRev is like GetIterator, but bounded to the revision
+	// range [fromRev, toRev]. A toRev of 0 means unbounded.
+	GetIteratorRev(key string, fromRev, toRev int64) (Iterator, error)
+
+	// GetIteratorRange is like GetIterator, but bounded to the timestamp
+	// range [from, to], and paginated by offset/limit. A limit of 0
+	// means unbounded.
+	GetIteratorRange(key string, from, to int64, offset, limit int) (Iterator, error)
+
+	// Delete writes a tombstone for key, preserving its history. Get and
+	// friends return ErrDeleted for a tombstoned key until it is Set
+	// again.
+	Delete(key string) error
+
+	// Purge hard-deletes the unlabeled history for key, and
+	// garbage-collects any value documents no longer referenced by a
+	// surviving entry. It does not touch any labeled variant of key; use
+	// PurgeWithLabels for those.
+	Purge(key string) error
+
+	// PurgeWithLabels is like Purge, but hard-deletes key's history
+	// scoped to labels instead of its unlabeled history.
+	PurgeWithLabels(key string, labels map[string]string) error
+
+	// Keys returns the distinct keys beginning with prefix, ordered and
+	// paginated by offset/limit. A limit of 0 means unbounded.
+	Keys(prefix string, offset, limit int) ([]string, error)
+
+	// Watch delivers every new KVLog set for key as it lands, until ctx
+	// is cancelled, at which point the returned channel is closed.
+	Watch(ctx context.Context, key string) (<-chan *KVLog, error)
+
+	// WatchPrefix is like Watch, but delivers every new KVLog whose key
+	// begins with prefix.
+	WatchPrefix(ctx context.Context, prefix string) (<-chan *KVLog, error)
+
+	// Compact deletes kvlog entries older than rev, other than the latest
+	// entry for each key, and garbage-collects any value documents no
+	// longer referenced by a surviving entry.
+	Compact(rev int64) error
+
+	// Recompress rewrites existing value documents under codec, in
+	// batches.
+	Recompress(codec string) error
+
+	// Disconnect releases any resources held by the Store.
+	Disconnect()
 }
 
-// findKVLogLatest finds the latest kvlog entry for key
-func (kdb *KDB) findKVLogLatest(key string) (*KVLog, error) {
-	kvlog := KVLog{}
-	filter := bson.D{
-		primitive.E{Key: "k", Value: key},
-	}
-	options := options.FindOne()
-	options.SetSort(bson.M{"ts": -1})
-	err := kdb.kc.FindOne(kdb.ctx, filter, options).Decode(&kvlog)
-	if err != nil {
-		return nil, err
-	}
-	return &kvlog, nil
+// Iterator is returned by Store.GetIterator to page through KVLog history.
+type Iterator interface {
+	// Next returns the next KVLog record from the iterator, or nil if no
+	// records remain, or an error occurred (which will be available via
+	// Err()).
+	Next() *KVLog
+
+	// Close marks the iterator as closed. Next() should not be called
+	// again after the iterator has been closed.
+	Close()
+
+	// Err returns the most recent error received from the iterator.
+	Err() error
 }
 
-// findKVLogAfter finds the first kvlog entry for key after ts
-func (kdb *KDB) findKVLogAfter(key string, ts int64) (*KVLog, error) {
-	kvlog := KVLog{}
-	filter := bson.D{
-		primitive.E{Key: "k", Value: key},
-		primitive.E{Key: "ts", Value: bson.D{
-			primitive.E{Key: "$gte", Value: ts},
-		}},
+// Factory constructs a Store from the given options. Drivers register a
+// Factory against a URI scheme using Register.
+type Factory func(ctx context.Context, opts KDBOptions) (Store, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Factory)
+)
+
+// Register makes a storage driver available under name (the URI scheme
+// used to select it, e.g. "mongodb", "sqlite", "postgres"). It is intended
+// to be called from a driver package's init function, mirroring the
+// database/sql driver-registration pattern. Register panics if called
+// twice with the same name, or if factory is nil.
+func Register(name string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if factory == nil {
+		panic("kvlog: Register factory is nil")
 	}
-	options := options.FindOne()
-	options.SetSort(bson.M{"ts": 1})
-	err := kdb.kc.FindOne(kdb.ctx, filter, options).Decode(&kvlog)
-	if err != nil {
-		return nil, err
+	if _, dup := drivers[name]; dup {
+		panic("kvlog: Register called twice for driver " + name)
 	}
-	return &kvlog, nil
+	drivers[name] = factory
 }
 
-// findValue finds value where _id == kvlog.vid
-func (kdb *KDB) findValue(vid string) (string, error) {
-	value := Value{}
-	filter := bson.D{primitive.E{Key: "_id", Value: vid}}
-	err := kdb.vc.FindOne(kdb.ctx, filter).Decode(&value)
+// schemeOf extracts the URI scheme used to select a driver, e.g. "mongodb"
+// from "mongodb://localhost/" or "sqlite" from "sqlite:///path/to/db".
+func schemeOf(uri string) (string, error) {
+	u, err := url.Parse(uri)
 	if err != nil {
 		return "", err
 	}
-	return value.Val, nil
-}
-
-// Set sets the current value for key to val (if not already val)
-func (kdb *KDB) Set(key, val string) error {
-	val = strings.TrimSpace(val)
-	vlen := len(val)
-
-	vid := ""
-	if vlen > maxInlineValueLength {
-		// find or insert value record
-		hash := sha1.Sum([]byte(val))
-		vid = hex.EncodeToString(hash[:])
-		_, err := kdb.findValue(vid)
-		if err != nil && err != mongo.ErrNoDocuments {
-			return err
-		}
-		if err != nil {
-			// vid not found - insert
-			//fmt.Printf("value for %q not found - inserting\n", val)
-			vrec := Value{ID: vid, Val: val}
-			_, err := kdb.vc.InsertOne(kdb.ctx, vrec)
-			if err != nil {
-				return err
-			}
-			//} else {
-			//fmt.Printf("value for %q found\n", val)
-		}
+	if u.Scheme == "" {
+		return "", fmt.Errorf("kvlog: URI %q has no scheme", uri)
 	}
+	return u.Scheme, nil
+}
 
-	// find or insert kvlog record
-	kvlog, err := kdb.findKVLogLatest(key)
-	if err != nil && err != mongo.ErrNoDocuments {
-		return err
+// NewKDBOptions creates a new connection to the kvlog database using
+// the ctx context and the given options, and returns a Store. The driver
+// used is selected by the scheme of opts.URI - the caller must have
+// imported the corresponding driver package (e.g. kvlog/mongo, kvlog/sqlite,
+// kvlog/postgres) so that it has registered itself. The caller is
+// responsible for calling Store.Disconnect when completed.
+func NewKDBOptions(ctx context.Context, opts KDBOptions) (Store, error) {
+	if opts.URI == "" {
+		opts.URI = defaultURI
 	}
-	if err != mongo.ErrNoDocuments {
-		if vid != "" && kvlog.vid == vid {
-			// latest kvlog record matches, we're done
-			//fmt.Printf("latest kvlog for %q found and vid matches\n", key)
-			return nil
-		} else if vid == "" && kvlog.Val == val {
-			// latest kvlog record matches, we're done
-			//fmt.Printf("latest kvlog for %q found and v matches\n", key)
-			return nil
-		}
+	if opts.DBName == "" {
+		opts.DBName = defaultDBName
 	}
 
-	// No kvlog record found, or vids don't match - do an insert
-	//fmt.Printf("kvlog for %q not found or out of date - inserting\n", key)
-	kvlog = &KVLog{Key: key, TS: time.Now().UnixNano()}
-	if vid == "" {
-		kvlog.Val = val
-	} else {
-		kvlog.vid = vid
-	}
-	_, err = kdb.kc.InsertOne(kdb.ctx, *kvlog)
+	scheme, err := schemeOf(opts.URI)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-}
-
-// Get fetches the latest value for key
-func (kdb *KDB) Get(key string) (string, error) {
-	kvlog, err := kdb.findKVLogLatest(key)
-	if err != nil {
-		return "", err
+	driversMu.RLock()
+	factory, ok := drivers[scheme]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("kvlog: no driver registered for scheme %q (forgotten import?)", scheme)
 	}
-	if kvlog.vid == "" {
-		return kvlog.Val, nil
-	}
-	return kdb.findValue(kvlog.vid)
-}
 
-// GetAt fetches the first value for key after ts
-func (kdb *KDB) GetAt(key string, ts int64) (string, error) {
-	kvlog, err := kdb.findKVLogAfter(key, ts)
+	store, err := factory(ctx, opts)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if kvlog.vid == "" {
-		return kvlog.Val, nil
+	if err := store.EnsureIndexes(); err != nil {
+		return nil, err
 	}
-	return kdb.findValue(kvlog.vid)
+	return store, nil
 }
 
-// GetIterator returns an Interator to fetch successive KVLog records,
-// in reverse timestamp order (i.e. latest first).
-// The caller is responsible for calling Close() on the returned
-// iterator once finished.
-func (kdb *KDB) GetIterator(key string) (*Iterator, error) {
-	filter := bson.D{
-		primitive.E{Key: "k", Value: key},
-	}
-	options := options.Find()
-	options.SetSort(bson.M{"ts": -1})
-	cursor, err := kdb.kc.Find(kdb.ctx, filter, options)
-	if err != nil {
-		return nil, err
-	}
-	it := Iterator{kdb: kdb, cursor: cursor}
-	return &it, nil
+// NewKDB creates a new connection to the kvlog database using the ctx
+// context and default options, and returns a Store. The caller is
+// responsible for calling Store.Disconnect when completed.
+func NewKDB(ctx context.Context) (Store, error) {
+	return NewKDBOptions(ctx, KDBOptions{})
 }
 
-func (kdb *KDB) Disconnect() {
-	kdb.client.Disconnect(kdb.ctx)
+// ValueID returns the content-address (hex-encoded SHA-1) used to key val
+// in a driver's value store. It is computed over the uncompressed content
+// so dedup remains stable regardless of any later compression codec.
+func ValueID(val string) string {
+	return sha1Hex(val)
 }
 
-// Next returns the next KVLog record from the iterator, or nil
-// if no records remain, or an error occurred (which will be
-// available via Iterator.Err()).
-func (it *Iterator) Next() *KVLog {
-	if it.cursor.Next(it.kdb.ctx) {
-		kvlog := KVLog{}
-		err := it.cursor.Decode(&kvlog)
-		if err != nil {
-			it.err = err
-			return nil
-		}
-		if kvlog.Val == "" {
-			val, err := it.kdb.findValue(kvlog.vid)
-			if err != nil {
-				it.err = err
-				return nil
-			}
-			kvlog.Val = val
-		}
-		return &kvlog
-	}
-	if err := it.cursor.Err(); err != nil {
-		it.err = err
-		return nil
+// LabelsHash returns a stable hex-encoded SHA-1 of the sorted label set,
+// used to scope a key's history to a particular label combination so
+// that unique indexes can key on (k, labels_hash, ts) rather than a raw
+// label map. The empty/nil label set has its own stable hash, so a key
+// set without labels keeps an independent history from any labeled
+// variant of that key.
+func LabelsHash(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
 	}
-	return nil
-}
+	sort.Strings(keys)
 
-// Close marks the iterator as closed. Next() should not be
-// called again after the iterator has been closed.
-func (it *Iterator) Close() {
-	it.cursor.Close(it.kdb.ctx)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+		b.WriteByte('\n')
+	}
+	return sha1Hex(b.String())
 }
 
-// Err returns the most recent error received from the iterator
-func (it *Iterator) Err() error {
-	return it.err
+func sha1Hex(s string) string {
+	hash := sha1.Sum([]byte(s))
+	return hex.EncodeToString(hash[:])
 }
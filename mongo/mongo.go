@@ -0,0 +1,688 @@
+// Package mongo implements the kvlog.Store interface on top of MongoDB.
+// Importing this package registers the "mongodb" driver with kvlog.
+package mongo
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/gavincarr/kvlog"
+)
+
+func init() {
+	kvlog.Register("mongodb", Open)
+}
+
+// Store implements kvlog.Store on top of a MongoDB database, using a
+// "kvlog" collection for keyed history, a "value" collection for
+// content-addressed values too large to store inline, and a "meta"
+// collection holding the revision counter.
+type Store struct {
+	ctx         context.Context
+	client      *mgo.Client
+	db          *mgo.Database
+	kc          *mgo.Collection // kvlog collection
+	vc          *mgo.Collection // value collection
+	mc          *mgo.Collection // meta collection
+	compression string
+}
+
+// Open connects to the MongoDB database referenced by opts.URI/opts.DBName
+// and returns a *Store. It is registered with kvlog as the "mongodb"
+// driver factory.
+func Open(ctx context.Context, opts kvlog.KDBOptions) (kvlog.Store, error) {
+	client, err := mgo.NewClient(options.Client().ApplyURI(opts.URI))
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	db := client.Database(opts.DBName)
+	kc := db.Collection("kvlog")
+	vc := db.Collection("value")
+	mc := db.Collection("meta")
+
+	compression := opts.Compression
+	if compression == "" {
+		compression = kvlog.DefaultCodec
+	}
+
+	return &Store{ctx: ctx, client: client, db: db, kc: kc, vc: vc, mc: mc, compression: compression}, nil
+}
+
+// EnsureIndexes checks that the indexes required by this driver exist,
+// creating them if necessary.
+func (s *Store) EnsureIndexes() error {
+	// db.kvlog.createIndex({ k:1, labels_hash:1, ts:-1 }, { unique:true })
+	model := mgo.IndexModel{
+		Keys: bson.D{
+			{Key: "k", Value: 1},
+			{Key: "labels_hash", Value: 1},
+			{Key: "ts", Value: -1},
+		},
+		Options: options.Index().SetName("k_labels_hash_ts").SetUnique(true),
+	}
+	_, err := s.kc.Indexes().CreateOne(s.ctx, model, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// findKVLogLatest finds the latest kvlog entry for key under labelsHash
+func (s *Store) findKVLogLatest(key, labelsHash string) (*kvlog.KVLog, error) {
+	kv := kvlog.KVLog{}
+	filter := bson.D{
+		primitive.E{Key: "k", Value: key},
+		primitive.E{Key: "labels_hash", Value: labelsHash},
+	}
+	opts := options.FindOne()
+	opts.SetSort(bson.M{"ts": -1})
+	err := s.kc.FindOne(s.ctx, filter, opts).Decode(&kv)
+	if err != nil {
+		return nil, err
+	}
+	return &kv, nil
+}
+
+// findKVLogAfter finds the first kvlog entry for key under labelsHash after ts
+func (s *Store) findKVLogAfter(key string, ts int64, labelsHash string) (*kvlog.KVLog, error) {
+	kv := kvlog.KVLog{}
+	filter := bson.D{
+		primitive.E{Key: "k", Value: key},
+		primitive.E{Key: "labels_hash", Value: labelsHash},
+		primitive.E{Key: "ts", Value: bson.D{
+			primitive.E{Key: "$gte", Value: ts},
+		}},
+	}
+	opts := options.FindOne()
+	opts.SetSort(bson.M{"ts": 1})
+	err := s.kc.FindOne(s.ctx, filter, opts).Decode(&kv)
+	if err != nil {
+		return nil, err
+	}
+	return &kv, nil
+}
+
+// findKVLogAfterRev finds the first kvlog entry for key under labelsHash
+// at or after revision rev
+func (s *Store) findKVLogAfterRev(key string, rev int64, labelsHash string) (*kvlog.KVLog, error) {
+	kv := kvlog.KVLog{}
+	filter := bson.D{
+		primitive.E{Key: "k", Value: key},
+		primitive.E{Key: "labels_hash", Value: labelsHash},
+		primitive.E{Key: "rev", Value: bson.D{
+			primitive.E{Key: "$gte", Value: rev},
+		}},
+	}
+	opts := options.FindOne()
+	opts.SetSort(bson.M{"rev": 1})
+	err := s.kc.FindOne(s.ctx, filter, opts).Decode(&kv)
+	if err != nil {
+		return nil, err
+	}
+	return &kv, nil
+}
+
+// findValue finds value where _id == kvlog.vid, decompressing its content
+// under the codec it was stored with.
+func (s *Store) findValue(vid string) (string, error) {
+	value := kvlog.Value{}
+	filter := bson.D{primitive.E{Key: "_id", Value: vid}}
+	err := s.vc.FindOne(s.ctx, filter).Decode(&value)
+	if err != nil {
+		return "", err
+	}
+	val, err := kvlog.Decompress(value.Codec, value.Val)
+	if err != nil {
+		return "", err
+	}
+	return string(val), nil
+}
+
+// nextRev atomically increments and returns the database's revision counter.
+func (s *Store) nextRev() (int64, error) {
+	filter := bson.D{primitive.E{Key: "_id", Value: "rev"}}
+	update := bson.D{primitive.E{Key: "$inc", Value: bson.D{{Key: "seq", Value: int64(1)}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var doc struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := s.mc.FindOneAndUpdate(s.ctx, filter, update, opts).Decode(&doc)
+	if err != nil {
+		return 0, err
+	}
+	return doc.Seq, nil
+}
+
+// CurrentRev returns the most recently issued revision, or 0 if no entries
+// have been set yet.
+func (s *Store) CurrentRev() (int64, error) {
+	var doc struct {
+		Seq int64 `bson:"seq"`
+	}
+	filter := bson.D{primitive.E{Key: "_id", Value: "rev"}}
+	err := s.mc.FindOne(s.ctx, filter).Decode(&doc)
+	if err == mgo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return doc.Seq, nil
+}
+
+// Set sets the current value for key to val (if not already val)
+func (s *Store) Set(key, val string) error {
+	return s.SetWithLabels(key, val, nil)
+}
+
+// SetWithLabels sets the current value for key, scoped to labels, to val
+// (if not already val)
+func (s *Store) SetWithLabels(key, val string, labels map[string]string) error {
+	val = strings.TrimSpace(val)
+	vlen := len(val)
+	labelsHash := kvlog.LabelsHash(labels)
+
+	vid := ""
+	if vlen > kvlog.MaxInlineValueLength {
+		// find or insert value record
+		vid = kvlog.ValueID(val)
+		_, err := s.findValue(vid)
+		if err != nil && err != mgo.ErrNoDocuments {
+			return err
+		}
+		if err != nil {
+			// vid not found - insert
+			compressed, err := kvlog.Compress(s.compression, []byte(val))
+			if err != nil {
+				return err
+			}
+			vrec := kvlog.Value{ID: vid, Val: compressed, Codec: s.compression, OrigLen: vlen}
+			_, err = s.vc.InsertOne(s.ctx, vrec)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// find or insert kvlog record
+	kv, err := s.findKVLogLatest(key, labelsHash)
+	if err != nil && err != mgo.ErrNoDocuments {
+		return err
+	}
+	if err != mgo.ErrNoDocuments && !kv.Deleted {
+		if vid != "" && kv.VID == vid {
+			// latest kvlog record matches, we're done
+			return nil
+		} else if vid == "" && kv.Val == val {
+			// latest kvlog record matches, we're done
+			return nil
+		}
+	}
+
+	rev, err := s.nextRev()
+	if err != nil {
+		return err
+	}
+
+	// No kvlog record found, or vids don't match - do an insert
+	kv = &kvlog.KVLog{Key: key, TS: time.Now().UnixNano(), Labels: labels, LabelsHash: labelsHash, Rev: rev}
+	if vid == "" {
+		kv.Val = val
+	} else {
+		kv.VID = vid
+	}
+	_, err = s.kc.InsertOne(s.ctx, *kv)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete writes a tombstone for key, preserving its history.
+func (s *Store) Delete(key string) error {
+	labelsHash := kvlog.LabelsHash(nil)
+	rev, err := s.nextRev()
+	if err != nil {
+		return err
+	}
+	kv := kvlog.KVLog{Key: key, TS: time.Now().UnixNano(), LabelsHash: labelsHash, Rev: rev, Deleted: true}
+	_, err = s.kc.InsertOne(s.ctx, kv)
+	return err
+}
+
+// Purge hard-deletes the unlabeled history for key, and garbage-collects
+// any value documents no longer referenced by a surviving entry.
+func (s *Store) Purge(key string) error {
+	return s.PurgeWithLabels(key, nil)
+}
+
+// PurgeWithLabels is like Purge, but hard-deletes key's history scoped to
+// labels instead of its unlabeled history.
+func (s *Store) PurgeWithLabels(key string, labels map[string]string) error {
+	_, err := s.kc.DeleteMany(s.ctx, bson.D{
+		{Key: "k", Value: key},
+		{Key: "labels_hash", Value: kvlog.LabelsHash(labels)},
+	})
+	if err != nil {
+		return err
+	}
+
+	liveVids, err := s.kc.Distinct(s.ctx, "vid", bson.D{{Key: "vid", Value: bson.D{{Key: "$ne", Value: ""}}}})
+	if err != nil {
+		return err
+	}
+	_, err = s.vc.DeleteMany(s.ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$nin", Value: liveVids}}}})
+	return err
+}
+
+// Keys returns the distinct keys beginning with prefix, ordered and
+// paginated by offset/limit. A limit of 0 means unbounded.
+func (s *Store) Keys(prefix string, offset, limit int) ([]string, error) {
+	pipeline := mgo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "k", Value: bson.D{
+			{Key: "$regex", Value: "^" + regexp.QuoteMeta(prefix)},
+		}}}}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$k"}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$skip", Value: int64(offset)}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: int64(limit)}})
+	}
+	cursor, err := s.kc.Aggregate(s.ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(s.ctx)
+
+	var keys []string
+	for cursor.Next(s.ctx) {
+		var doc struct {
+			ID string `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		keys = append(keys, doc.ID)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Get fetches the latest value for key
+func (s *Store) Get(key string) (string, error) {
+	kv, err := s.findKVLogLatest(key, kvlog.LabelsHash(nil))
+	if err != nil {
+		return "", err
+	}
+	if kv.Deleted {
+		return "", kvlog.ErrDeleted
+	}
+	if kv.VID == "" {
+		return kv.Val, nil
+	}
+	return s.findValue(kv.VID)
+}
+
+// GetAt fetches the first value for key after ts
+func (s *Store) GetAt(key string, ts int64) (string, error) {
+	kv, err := s.findKVLogAfter(key, ts, kvlog.LabelsHash(nil))
+	if err != nil {
+		return "", err
+	}
+	if kv.Deleted {
+		return "", kvlog.ErrDeleted
+	}
+	if kv.VID == "" {
+		return kv.Val, nil
+	}
+	return s.findValue(kv.VID)
+}
+
+// GetAtRev fetches the first value for key at or after revision rev
+func (s *Store) GetAtRev(key string, rev int64) (string, error) {
+	kv, err := s.findKVLogAfterRev(key, rev, kvlog.LabelsHash(nil))
+	if err != nil {
+		return "", err
+	}
+	if kv.Deleted {
+		return "", kvlog.ErrDeleted
+	}
+	if kv.VID == "" {
+		return kv.Val, nil
+	}
+	return s.findValue(kv.VID)
+}
+
+// GetByLabels fetches the latest KVLog for every key that has an entry
+// scoped to labels.
+func (s *Store) GetByLabels(labels map[string]string) ([]*kvlog.KVLog, error) {
+	pipeline := mgo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "labels_hash", Value: kvlog.LabelsHash(labels)}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "ts", Value: -1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$k"},
+			{Key: "doc", Value: bson.D{{Key: "$first", Value: "$$ROOT"}}},
+		}}},
+		{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$doc"}}}},
+	}
+	cursor, err := s.kc.Aggregate(s.ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(s.ctx)
+
+	var results []*kvlog.KVLog
+	for cursor.Next(s.ctx) {
+		kv := kvlog.KVLog{}
+		if err := cursor.Decode(&kv); err != nil {
+			return nil, err
+		}
+		if kv.Deleted {
+			// a tombstoned key has no current value for this label
+			// combination, so omit it rather than surface an empty Val.
+			continue
+		}
+		if kv.VID != "" {
+			val, err := s.findValue(kv.VID)
+			if err != nil {
+				return nil, err
+			}
+			kv.Val = val
+		}
+		results = append(results, &kv)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GetIterator returns an Iterator to fetch successive KVLog records,
+// in reverse timestamp order (i.e. latest first).
+// The caller is responsible for calling Close() on the returned
+// iterator once finished.
+func (s *Store) GetIterator(key string) (kvlog.Iterator, error) {
+	return s.getIterator(key, kvlog.LabelsHash(nil))
+}
+
+// GetIteratorByLabels is like GetIterator, but scoped to the history of
+// key under labels.
+func (s *Store) GetIteratorByLabels(key string, labels map[string]string) (kvlog.Iterator, error) {
+	return s.getIterator(key, kvlog.LabelsHash(labels))
+}
+
+func (s *Store) getIterator(key, labelsHash string) (kvlog.Iterator, error) {
+	filter := bson.D{
+		primitive.E{Key: "k", Value: key},
+		primitive.E{Key: "labels_hash", Value: labelsHash},
+	}
+	opts := options.Find()
+	opts.SetSort(bson.M{"ts": -1})
+	cursor, err := s.kc.Find(s.ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{store: s, cursor: cursor}, nil
+}
+
+// GetIteratorRev is like GetIterator, but bounded to the revision range
+// [fromRev, toRev]. A toRev of 0 means unbounded.
+func (s *Store) GetIteratorRev(key string, fromRev, toRev int64) (kvlog.Iterator, error) {
+	rev := bson.D{primitive.E{Key: "$gte", Value: fromRev}}
+	if toRev > 0 {
+		rev = append(rev, primitive.E{Key: "$lte", Value: toRev})
+	}
+	filter := bson.D{
+		primitive.E{Key: "k", Value: key},
+		primitive.E{Key: "labels_hash", Value: kvlog.LabelsHash(nil)},
+		primitive.E{Key: "rev", Value: rev},
+	}
+	opts := options.Find()
+	opts.SetSort(bson.M{"rev": -1})
+	cursor, err := s.kc.Find(s.ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{store: s, cursor: cursor}, nil
+}
+
+// GetIteratorRange is like GetIterator, but bounded to the timestamp range
+// [from, to], and paginated by offset/limit. A limit of 0 means unbounded.
+func (s *Store) GetIteratorRange(key string, from, to int64, offset, limit int) (kvlog.Iterator, error) {
+	filter := bson.D{
+		primitive.E{Key: "k", Value: key},
+		primitive.E{Key: "labels_hash", Value: kvlog.LabelsHash(nil)},
+		primitive.E{Key: "ts", Value: bson.D{
+			primitive.E{Key: "$gte", Value: from},
+			primitive.E{Key: "$lte", Value: to},
+		}},
+	}
+	opts := options.Find()
+	opts.SetSort(bson.M{"ts": -1})
+	opts.SetSkip(int64(offset))
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := s.kc.Find(s.ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{store: s, cursor: cursor}, nil
+}
+
+// Compact deletes kvlog entries older than rev, other than the latest entry
+// for each (key, labels) pair, and garbage-collects any value documents no
+// longer referenced by a surviving entry.
+func (s *Store) Compact(rev int64) error {
+	pipeline := mgo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "ts", Value: -1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "k", Value: "$k"}, {Key: "labels_hash", Value: "$labels_hash"}}},
+			{Key: "keepID", Value: bson.D{{Key: "$first", Value: "$_id"}}},
+		}}},
+	}
+	cursor, err := s.kc.Aggregate(s.ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var keepIDs []interface{}
+	for cursor.Next(s.ctx) {
+		var doc struct {
+			KeepID primitive.ObjectID `bson:"keepID"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			cursor.Close(s.ctx)
+			return err
+		}
+		keepIDs = append(keepIDs, doc.KeepID)
+	}
+	if err := cursor.Err(); err != nil {
+		cursor.Close(s.ctx)
+		return err
+	}
+	cursor.Close(s.ctx)
+
+	_, err = s.kc.DeleteMany(s.ctx, bson.D{
+		{Key: "rev", Value: bson.D{{Key: "$lt", Value: rev}}},
+		{Key: "_id", Value: bson.D{{Key: "$nin", Value: keepIDs}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	liveVids, err := s.kc.Distinct(s.ctx, "vid", bson.D{{Key: "vid", Value: bson.D{{Key: "$ne", Value: ""}}}})
+	if err != nil {
+		return err
+	}
+	_, err = s.vc.DeleteMany(s.ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$nin", Value: liveVids}}}})
+	return err
+}
+
+// Recompress rewrites every value document under codec, decompressing
+// each with its stored codec and recompressing before updating it in
+// place. It does not affect the content-address (vid) of any value.
+func (s *Store) Recompress(codec string) error {
+	cursor, err := s.vc.Find(s.ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(s.ctx)
+
+	for cursor.Next(s.ctx) {
+		value := kvlog.Value{}
+		if err := cursor.Decode(&value); err != nil {
+			return err
+		}
+		if value.Codec == codec {
+			continue
+		}
+		raw, err := kvlog.Decompress(value.Codec, value.Val)
+		if err != nil {
+			return err
+		}
+		compressed, err := kvlog.Compress(codec, raw)
+		if err != nil {
+			return err
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "v", Value: compressed},
+			{Key: "codec", Value: codec},
+			{Key: "orig_len", Value: len(raw)},
+		}}}
+		_, err = s.vc.UpdateOne(s.ctx, bson.D{{Key: "_id", Value: value.ID}}, update)
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *Store) Disconnect() {
+	s.client.Disconnect(s.ctx)
+}
+
+// changeEvent is the subset of a MongoDB change stream insert event this
+// driver cares about.
+type changeEvent struct {
+	FullDocument kvlog.KVLog `bson:"fullDocument"`
+}
+
+// watch delivers the fullDocument of every insert event matching match,
+// via change streams, until ctx is cancelled.
+func (s *Store) watch(ctx context.Context, match bson.D) (<-chan *kvlog.KVLog, error) {
+	pipeline := mgo.Pipeline{{{Key: "$match", Value: match}}}
+	cs, err := s.kc.Watch(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *kvlog.KVLog)
+	go func() {
+		defer close(ch)
+		defer cs.Close(context.Background())
+		for cs.Next(ctx) {
+			var ev changeEvent
+			if err := cs.Decode(&ev); err != nil {
+				return
+			}
+			kv := ev.FullDocument
+			if kv.Val == "" && kv.VID != "" {
+				val, err := s.findValue(kv.VID)
+				if err != nil {
+					return
+				}
+				kv.Val = val
+			}
+			select {
+			case ch <- &kv:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Watch delivers every new KVLog set for key as it lands, until ctx is
+// cancelled, at which point the returned channel is closed.
+func (s *Store) Watch(ctx context.Context, key string) (<-chan *kvlog.KVLog, error) {
+	return s.watch(ctx, bson.D{
+		{Key: "operationType", Value: "insert"},
+		{Key: "fullDocument.k", Value: key},
+	})
+}
+
+// WatchPrefix is like Watch, but delivers every new KVLog whose key begins
+// with prefix.
+func (s *Store) WatchPrefix(ctx context.Context, prefix string) (<-chan *kvlog.KVLog, error) {
+	return s.watch(ctx, bson.D{
+		{Key: "operationType", Value: "insert"},
+		{Key: "fullDocument.k", Value: bson.D{
+			{Key: "$regex", Value: "^" + regexp.QuoteMeta(prefix)},
+		}},
+	})
+}
+
+// iterator implements kvlog.Iterator on top of a mongo.Cursor.
+type iterator struct {
+	store  *Store
+	cursor *mgo.Cursor
+	err    error
+}
+
+// Next returns the next KVLog record from the iterator, or nil
+// if no records remain, or an error occurred (which will be
+// available via Iterator.Err()).
+func (it *iterator) Next() *kvlog.KVLog {
+	if it.cursor.Next(it.store.ctx) {
+		kv := kvlog.KVLog{}
+		err := it.cursor.Decode(&kv)
+		if err != nil {
+			it.err = err
+			return nil
+		}
+		if kv.Val == "" && kv.VID != "" {
+			val, err := it.store.findValue(kv.VID)
+			if err != nil {
+				it.err = err
+				return nil
+			}
+			kv.Val = val
+		}
+		return &kv
+	}
+	if err := it.cursor.Err(); err != nil {
+		it.err = err
+		return nil
+	}
+	return nil
+}
+
+// Close marks the iterator as closed. Next() should not be
+// called again after the iterator has been closed.
+func (it *iterator) Close() {
+	it.cursor.Close(it.store.ctx)
+}
+
+// Err returns the most recent error received from the iterator
+func (it *iterator) Err() error {
+	return it.err
+}
@@ -1,4 +1,4 @@
-package kvlog
+package mongo
 
 import (
 	"context"
@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/gavincarr/kvlog"
 )
 
 const dbname = "kvlog_test"
@@ -17,24 +19,25 @@ func TestBasic(t *testing.T) {
 	ctx, _ := context.WithTimeout(context.Background(), time.Second*10)
 	ts := time.Now().UnixNano()
 
-	kdb, err := NewKDBOptions(ctx, KDBOptions{DBName: dbname})
+	store, err := kvlog.NewKDBOptions(ctx, kvlog.KDBOptions{URI: "mongodb://localhost/", DBName: dbname})
 	if err != nil {
 		t.Fatal("constructor error: ", err)
 	}
-	defer kdb.Disconnect()
+	defer store.Disconnect()
+	s := store.(*Store)
 
 	// Drop existing collections to start clean
-	kdb.kc.Drop(ctx)
-	kdb.vc.Drop(ctx)
+	s.kc.Drop(ctx)
+	s.vc.Drop(ctx)
 
 	// Recreate indexes (though not really required for testing)
-	err = createIndexes(ctx, kdb.kc)
+	err = s.EnsureIndexes()
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Set/Get tests with []values
-	val, err := kdb.GetAt("foo", ts)
+	val, err := store.GetAt("foo", ts)
 	if err != nil && err != mongo.ErrNoDocuments {
 		t.Fatalf("error on GetAt: %s\n", err.Error())
 	}
@@ -44,12 +47,12 @@ func TestBasic(t *testing.T) {
 
 	k := "foo"
 	for i, v := range values {
-		err = kdb.Set(k, v)
+		err = store.Set(k, v)
 		if err != nil {
 			t.Errorf("error on Set%d (%s/%s): %s\n", i, k, v, err.Error())
 		}
 
-		val, err = kdb.Get(k)
+		val, err = store.Get(k)
 		if err != nil {
 			t.Errorf("error on Get%d (%s/%s): %s\n", i, k, v, err.Error())
 		}
@@ -60,13 +63,13 @@ func TestBasic(t *testing.T) {
 
 	// Set/Get test with a long string
 	k = "test"
-	b, err := ioutil.ReadFile("kvlog_test.go")
+	b, err := ioutil.ReadFile("mongo_test.go")
 	v := string(b)
-	err = kdb.Set("test", v)
+	err = store.Set("test", v)
 	if err != nil {
 		t.Errorf("error on long Set (%s): %s\n", v, err.Error())
 	}
-	val, err = kdb.Get(k)
+	val, err = store.Get(k)
 	if err != nil {
 		t.Errorf("error on long Get (%s): %s\n", k, err.Error())
 	}
@@ -76,7 +79,7 @@ func TestBasic(t *testing.T) {
 	}
 
 	// GetAt
-	val, err = kdb.GetAt("foo", ts)
+	val, err = store.GetAt("foo", ts)
 	expect := values[0]
 	if err != nil {
 		t.Errorf("error on GetAt: %s\n", err.Error())
@@ -86,20 +89,20 @@ func TestBasic(t *testing.T) {
 	}
 
 	// GetIterator
-	it, err := kdb.GetIterator("foo")
+	it, err := store.GetIterator("foo")
 	if err != nil {
 		t.Errorf("error on GetIterator: %s\n", err.Error())
 	}
 	defer it.Close()
-	kvlog := it.Next()
+	kv := it.Next()
 	i := 1
-	for kvlog != nil {
+	for kv != nil {
 		expect = values[len(values)-i]
-		if kvlog.Val != expect {
-			t.Errorf("error on iterator %d: expecting %q, got %q\n", i, expect, kvlog.Val)
+		if kv.Val != expect {
+			t.Errorf("error on iterator %d: expecting %q, got %q\n", i, expect, kv.Val)
 		}
 
-		kvlog = it.Next()
+		kv = it.Next()
 		i += 1
 	}
 	if err = it.Err(); err != nil {
@@ -0,0 +1,38 @@
+// Package postgres implements the kvlog.Store interface on top of
+// PostgreSQL. Importing this package registers the "postgres" driver
+// with kvlog.
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	_ "github.com/lib/pq"
+
+	"github.com/gavincarr/kvlog"
+	"github.com/gavincarr/kvlog/internal/sqlstore"
+)
+
+func init() {
+	kvlog.Register("postgres", Open)
+}
+
+var dialect = sqlstore.Dialect{
+	DriverName: "postgres",
+	DSN: func(uri string) string {
+		return uri
+	},
+	Placeholder: func(n int) string {
+		return fmt.Sprintf("$%d", n)
+	},
+}
+
+// Open connects to the PostgreSQL database referenced by opts.URI and
+// returns a *sqlstore.Store. It is registered with kvlog as the
+// "postgres" driver factory.
+func Open(ctx context.Context, opts kvlog.KDBOptions) (kvlog.Store, error) {
+	if opts.URI == "" {
+		return nil, fmt.Errorf("kvlog/postgres: no URI given")
+	}
+	return sqlstore.Open(ctx, opts, dialect)
+}
@@ -0,0 +1,56 @@
+// Package sqlite implements the kvlog.Store interface on top of SQLite.
+// Importing this package registers the "sqlite" driver with kvlog.
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/gavincarr/kvlog"
+	"github.com/gavincarr/kvlog/internal/sqlstore"
+)
+
+func init() {
+	kvlog.Register("sqlite", Open)
+}
+
+var dialect = sqlstore.Dialect{
+	DriverName: "sqlite3",
+	DSN:        dsn,
+	Placeholder: func(n int) string {
+		return "?"
+	},
+	// go-sqlite3 defaults to a zero busy timeout, so any overlap between
+	// e.g. a Set and a still-open GetIterator cursor fails immediately
+	// with "database is locked". Capping the pool at one connection, on
+	// top of the busy timeout set in dsn, serializes access through a
+	// single sqlite connection the way this embedded/server-less backend
+	// needs.
+	MaxOpenConns: 1,
+}
+
+// dsn converts a "sqlite:///path/to/db" URI into the plain filesystem path
+// go-sqlite3 expects, adding a busy timeout so that the brief lock
+// contention from concurrent reads and writes is retried rather than
+// failing outright.
+func dsn(uri string) string {
+	path := strings.TrimPrefix(uri, "sqlite://")
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_busy_timeout=5000"
+}
+
+// Open opens the single-file SQLite database referenced by opts.URI and
+// returns a *sqlstore.Store. It is registered with kvlog as the "sqlite"
+// driver factory.
+func Open(ctx context.Context, opts kvlog.KDBOptions) (kvlog.Store, error) {
+	if opts.URI == "" {
+		return nil, fmt.Errorf("kvlog/sqlite: no URI given")
+	}
+	return sqlstore.Open(ctx, opts, dialect)
+}
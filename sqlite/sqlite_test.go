@@ -0,0 +1,389 @@
+package sqlite
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gavincarr/kvlog"
+)
+
+// newStore opens a fresh in-memory sqlite store for the duration of a test.
+func newStore(t *testing.T) kvlog.Store {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	store, err := kvlog.NewKDBOptions(ctx, kvlog.KDBOptions{URI: "sqlite://:memory:"})
+	if err != nil {
+		t.Fatal("constructor error: ", err)
+	}
+	t.Cleanup(store.Disconnect)
+	return store
+}
+
+func TestLabels(t *testing.T) {
+	store := newStore(t)
+
+	k := "colour"
+	if err := store.Set(k, "red"); err != nil {
+		t.Fatalf("error on unlabeled Set: %s", err)
+	}
+
+	prod := map[string]string{"env": "prod"}
+	dev := map[string]string{"env": "dev"}
+	if err := store.SetWithLabels(k, "blue", prod); err != nil {
+		t.Fatalf("error on Set prod: %s", err)
+	}
+	if err := store.SetWithLabels(k, "green", dev); err != nil {
+		t.Fatalf("error on Set dev: %s", err)
+	}
+
+	// Unlabeled history is independent of either labeled scope.
+	val, err := store.Get(k)
+	if err != nil {
+		t.Fatalf("error on unlabeled Get: %s", err)
+	}
+	if val != "red" {
+		t.Errorf("unlabeled Get: expecting %q, got %q", "red", val)
+	}
+
+	it, err := store.GetIteratorByLabels(k, prod)
+	if err != nil {
+		t.Fatalf("error on GetIteratorByLabels(prod): %s", err)
+	}
+	kv := it.Next()
+	it.Close()
+	if kv == nil {
+		t.Fatal("GetIteratorByLabels(prod): expecting a record, got none")
+	}
+	if kv.Val != "blue" {
+		t.Errorf("GetIteratorByLabels(prod): expecting %q, got %q", "blue", kv.Val)
+	}
+
+	results, err := store.GetByLabels(dev)
+	if err != nil {
+		t.Fatalf("error on GetByLabels(dev): %s", err)
+	}
+	if len(results) != 1 || results[0].Val != "green" {
+		t.Errorf("GetByLabels(dev): expecting one record %q, got %+v", "green", results)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	store := newStore(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ch, err := store.Watch(ctx, "foo")
+	if err != nil {
+		t.Fatalf("error on Watch: %s", err)
+	}
+
+	if err := store.Set("bar", "ignored"); err != nil {
+		t.Fatalf("error on Set(bar): %s", err)
+	}
+	if err := store.Set("foo", "one"); err != nil {
+		t.Fatalf("error on Set(foo, one): %s", err)
+	}
+	if err := store.Set("foo", "two"); err != nil {
+		t.Fatalf("error on Set(foo, two): %s", err)
+	}
+
+	for _, expect := range []string{"one", "two"} {
+		select {
+		case kv := <-ch:
+			if kv.Key != "foo" || kv.Val != expect {
+				t.Errorf("Watch: expecting foo=%q, got %s=%q", expect, kv.Key, kv.Val)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Watch: timed out waiting for %q", expect)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Errorf("Watch: expecting channel to be closed after cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch: timed out waiting for channel close")
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	store := newStore(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ch, err := store.WatchPrefix(ctx, "app/")
+	if err != nil {
+		t.Fatalf("error on WatchPrefix: %s", err)
+	}
+
+	if err := store.Set("other/foo", "ignored"); err != nil {
+		t.Fatalf("error on Set(other/foo): %s", err)
+	}
+	if err := store.Set("app/foo", "bar"); err != nil {
+		t.Fatalf("error on Set(app/foo): %s", err)
+	}
+
+	select {
+	case kv := <-ch:
+		if kv.Key != "app/foo" || kv.Val != "bar" {
+			t.Errorf("WatchPrefix: expecting app/foo=%q, got %s=%q", "bar", kv.Key, kv.Val)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchPrefix: timed out waiting for app/foo")
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	store := newStore(t)
+
+	if rev, err := store.CurrentRev(); err != nil || rev != 0 {
+		t.Fatalf("CurrentRev before any Set: expecting 0/nil, got %d/%v", rev, err)
+	}
+
+	k := "foo"
+	values := []string{"one", "two", "three"}
+	for _, v := range values {
+		if err := store.Set(k, v); err != nil {
+			t.Fatalf("error on Set(%s): %s", v, err)
+		}
+	}
+
+	rev, err := store.CurrentRev()
+	if err != nil {
+		t.Fatalf("error on CurrentRev: %s", err)
+	}
+	if rev != int64(len(values)) {
+		t.Errorf("CurrentRev: expecting %d, got %d", len(values), rev)
+	}
+
+	val, err := store.GetAtRev(k, rev)
+	if err != nil {
+		t.Fatalf("error on GetAtRev(%d): %s", rev, err)
+	}
+	if val != values[len(values)-1] {
+		t.Errorf("GetAtRev(%d): expecting %q, got %q", rev, values[len(values)-1], val)
+	}
+
+	val, err = store.GetAtRev(k, 1)
+	if err != nil {
+		t.Fatalf("error on GetAtRev(1): %s", err)
+	}
+	if val != values[0] {
+		t.Errorf("GetAtRev(1): expecting %q, got %q", values[0], val)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	store := newStore(t)
+
+	k := "foo"
+	values := []string{"one", "two", "three", "four"}
+	for _, v := range values {
+		if err := store.Set(k, v); err != nil {
+			t.Fatalf("error on Set(%s): %s", v, err)
+		}
+	}
+
+	rev, err := store.CurrentRev()
+	if err != nil {
+		t.Fatalf("error on CurrentRev: %s", err)
+	}
+	if err := store.Compact(rev); err != nil {
+		t.Fatalf("error on Compact(%d): %s", rev, err)
+	}
+
+	// Only the latest entry for k should survive compaction.
+	it, err := store.GetIterator(k)
+	if err != nil {
+		t.Fatalf("error on GetIterator: %s", err)
+	}
+	defer it.Close()
+
+	count := 0
+	for kv := it.Next(); kv != nil; kv = it.Next() {
+		count++
+		if kv.Val != values[len(values)-1] {
+			t.Errorf("Compact: surviving entry: expecting %q, got %q", values[len(values)-1], kv.Val)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("error from iterator: %s", err)
+	}
+	if count != 1 {
+		t.Errorf("Compact: expecting 1 surviving entry, got %d", count)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store, err := kvlog.NewKDBOptions(ctx, kvlog.KDBOptions{
+		URI:         "sqlite://:memory:",
+		Compression: kvlog.CodecGzip,
+	})
+	if err != nil {
+		t.Fatal("constructor error: ", err)
+	}
+	defer store.Disconnect()
+
+	k := "foo"
+	v := strings.TrimSpace(strings.Repeat("the quick brown fox jumps over the lazy dog ", 20))
+	if err := store.Set(k, v); err != nil {
+		t.Fatalf("error on Set: %s", err)
+	}
+
+	val, err := store.Get(k)
+	if err != nil {
+		t.Fatalf("error on Get: %s", err)
+	}
+	if val != v {
+		t.Errorf("Get: content mismatch (got %dB, expected %dB)", len(val), len(v))
+	}
+
+	if err := store.Recompress(kvlog.CodecS2); err != nil {
+		t.Fatalf("error on Recompress: %s", err)
+	}
+
+	val, err = store.Get(k)
+	if err != nil {
+		t.Fatalf("error on Get after Recompress: %s", err)
+	}
+	if val != v {
+		t.Errorf("Get after Recompress: content mismatch (got %dB, expected %dB)", len(val), len(v))
+	}
+}
+
+func TestDelete(t *testing.T) {
+	store := newStore(t)
+
+	k := "foo"
+	if err := store.Set(k, "bar"); err != nil {
+		t.Fatalf("error on Set: %s", err)
+	}
+	if err := store.Delete(k); err != nil {
+		t.Fatalf("error on Delete: %s", err)
+	}
+
+	if _, err := store.Get(k); err != kvlog.ErrDeleted {
+		t.Errorf("Get after Delete: expecting ErrDeleted, got %v", err)
+	}
+
+	// Set after Delete must revive the key.
+	if err := store.Set(k, "baz"); err != nil {
+		t.Fatalf("error on Set after Delete: %s", err)
+	}
+	val, err := store.Get(k)
+	if err != nil {
+		t.Fatalf("error on Get after revive: %s", err)
+	}
+	if val != "baz" {
+		t.Errorf("Get after revive: expecting %q, got %q", "baz", val)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	store := newStore(t)
+
+	k := "foo"
+	prod := map[string]string{"env": "prod"}
+	if err := store.Set(k, "bar"); err != nil {
+		t.Fatalf("error on Set: %s", err)
+	}
+	if err := store.SetWithLabels(k, "baz", prod); err != nil {
+		t.Fatalf("error on SetWithLabels: %s", err)
+	}
+
+	if err := store.Purge(k); err != nil {
+		t.Fatalf("error on Purge: %s", err)
+	}
+	if _, err := store.Get(k); err == nil {
+		t.Errorf("Get after Purge: expecting an error, got none")
+	}
+
+	// Purge must not have touched the labeled history.
+	val, err := store.GetByLabels(prod)
+	if err != nil {
+		t.Fatalf("error on GetByLabels after Purge: %s", err)
+	}
+	if len(val) != 1 || val[0].Val != "baz" {
+		t.Errorf("GetByLabels after Purge: expecting one record %q, got %+v", "baz", val)
+	}
+
+	if err := store.PurgeWithLabels(k, prod); err != nil {
+		t.Fatalf("error on PurgeWithLabels: %s", err)
+	}
+	val, err = store.GetByLabels(prod)
+	if err != nil {
+		t.Fatalf("error on GetByLabels after PurgeWithLabels: %s", err)
+	}
+	if len(val) != 0 {
+		t.Errorf("GetByLabels after PurgeWithLabels: expecting no records, got %+v", val)
+	}
+}
+
+func TestGetIteratorRange(t *testing.T) {
+	store := newStore(t)
+
+	k := "foo"
+	values := []string{"one", "two", "three", "four"}
+	var timestamps []int64
+	for _, v := range values {
+		if err := store.Set(k, v); err != nil {
+			t.Fatalf("error on Set(%s): %s", v, err)
+		}
+		timestamps = append(timestamps, time.Now().UnixNano())
+		time.Sleep(time.Millisecond)
+	}
+
+	// The middle two entries (two, three) fall within [timestamps[0], timestamps[2]].
+	it, err := store.GetIteratorRange(k, timestamps[0], timestamps[2], 0, 0)
+	if err != nil {
+		t.Fatalf("error on GetIteratorRange: %s", err)
+	}
+	defer it.Close()
+
+	var got []string
+	for kv := it.Next(); kv != nil; kv = it.Next() {
+		got = append(got, kv.Val)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("error from iterator: %s", err)
+	}
+	if len(got) != 2 || got[0] != "three" || got[1] != "two" {
+		t.Errorf("GetIteratorRange: expecting [three two], got %v", got)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	store := newStore(t)
+
+	for _, k := range []string{"app/one", "app/two", "other/one"} {
+		if err := store.Set(k, "v"); err != nil {
+			t.Fatalf("error on Set(%s): %s", k, err)
+		}
+	}
+
+	keys, err := store.Keys("app/", 0, 0)
+	if err != nil {
+		t.Fatalf("error on Keys: %s", err)
+	}
+	if len(keys) != 2 || keys[0] != "app/one" || keys[1] != "app/two" {
+		t.Errorf("Keys: expecting [app/one app/two], got %v", keys)
+	}
+
+	keys, err = store.Keys("app/", 1, 1)
+	if err != nil {
+		t.Fatalf("error on Keys (paginated): %s", err)
+	}
+	if len(keys) != 1 || keys[0] != "app/two" {
+		t.Errorf("Keys (paginated): expecting [app/two], got %v", keys)
+	}
+}